@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timelapseMeta is sidecar metadata written next to each generated video
+// (as "<video>.json"), so the API can report frame count and encoder
+// without having to re-derive them from the video file itself.
+type timelapseMeta struct {
+	FrameCount int    `json:"frame_count"`
+	FPS        int    `json:"fps"`
+	Encoder    string `json:"encoder"`
+}
+
+func writeTimelapseMeta(videoPath string, meta timelapseMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(videoPath+".json", data, 0644)
+}
+
+// TimelapseInfo describes a single generated timelapse, served by
+// GET /api/timelapses.
+type TimelapseInfo struct {
+	Date       string  `json:"date"`
+	URL        string  `json:"url"`
+	FrameCount int     `json:"frame_count"`
+	DurationS  float64 `json:"duration_s"`
+	SizeBytes  int64   `json:"size_bytes"`
+	Encoder    string  `json:"encoder"`
+}
+
+// listTimelapses scans outDir for generated timelapse files, pairing each
+// with its sidecar metadata (if any), and returns them sorted by date.
+func listTimelapses(outDir string) ([]TimelapseInfo, error) {
+	files, err := ioutil.ReadDir(outDir)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]TimelapseInfo, 0)
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if !timelapseExtensions[ext] {
+			continue
+		}
+
+		dateStr := strings.TrimSuffix(file.Name(), ext)
+		if _, err := ParseDate(dateStr); err != nil {
+			continue
+		}
+
+		info := TimelapseInfo{
+			Date:      dateStr,
+			URL:       "/" + file.Name(),
+			SizeBytes: file.Size(),
+		}
+
+		var meta timelapseMeta
+		if data, err := ioutil.ReadFile(filepath.Join(outDir, file.Name()+".json")); err == nil {
+			if err := json.Unmarshal(data, &meta); err == nil {
+				info.FrameCount = meta.FrameCount
+				info.Encoder = meta.Encoder
+				if meta.FPS > 0 {
+					info.DurationS = float64(meta.FrameCount) / float64(meta.FPS)
+				}
+			}
+		}
+
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Date < infos[j].Date })
+
+	return infos, nil
+}
+
+// RunState describes what phase of an update cycle the server is in.
+type RunState string
+
+const (
+	RunStateIdle     RunState = "idle"
+	RunStateScanning RunState = "scanning"
+	RunStateEncoding RunState = "encoding"
+)
+
+// Status is the current state of the background update pipeline, served
+// at GET /api/status. It's updated from the pipeline stages as they run.
+type Status struct {
+	mutex sync.Mutex
+
+	state     RunState
+	progress  int
+	total     int
+	lastError string
+}
+
+// start begins a new phase with a fresh progress counter. It also clears
+// lastError: a new run starts clean, and will report its own error again
+// if it fails, rather than a failure from a previous run persisting
+// forever once the pipeline has recovered.
+func (s *Status) start(state RunState, total int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state = state
+	s.progress = 0
+	s.total = total
+	s.lastError = ""
+}
+
+// increment advances the progress counter of the current phase by one.
+func (s *Status) increment() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.progress++
+}
+
+// idle marks the pipeline as having returned to rest.
+func (s *Status) idle() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state = RunStateIdle
+	s.progress = 0
+	s.total = 0
+}
+
+func (s *Status) setError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastError = err.Error()
+}
+
+type statusResponse struct {
+	State     string `json:"state"`
+	Progress  int    `json:"progress"`
+	Total     int    `json:"total"`
+	LastError string `json:"last_error"`
+}
+
+func (s *Status) snapshot() statusResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return statusResponse{
+		State:     string(s.state),
+		Progress:  s.progress,
+		Total:     s.total,
+		LastError: s.lastError,
+	}
+}
+
+func timelapsesHandler(outDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		infos, err := listTimelapses(outDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	}
+}
+
+func statusHandler(status *Status) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status.snapshot())
+	}
+}
+
+// regenerateHandler triggers an on-demand rebuild of a single day's
+// timelapse. regenerate is expected to run asynchronously.
+func regenerateHandler(regenerate func(date time.Time)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		dateStr := r.URL.Query().Get("date")
+		date, err := ParseDate(dateStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid date %q: %v", dateStr, err), http.StatusBadRequest)
+			return
+		}
+
+		go regenerate(date)
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+const indexHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>Timelapses</title>
+  <style>
+    body { font-family: sans-serif; margin: 2em; background: #111; color: #eee; }
+    .timelapse { margin-bottom: 2em; }
+    video { max-width: 100%; background: #000; }
+  </style>
+</head>
+<body>
+  <h1>Timelapses</h1>
+  <div id="gallery"></div>
+  <script>
+    fetch('/api/timelapses')
+      .then(function (resp) { return resp.json(); })
+      .then(function (timelapses) {
+        var gallery = document.getElementById('gallery');
+        timelapses.forEach(function (t) {
+          var div = document.createElement('div');
+          div.className = 'timelapse';
+          div.innerHTML =
+            '<h2>' + t.date + '</h2>' +
+            '<video controls src="' + t.url + '"></video>' +
+            '<p>' + t.frame_count + ' frames, ' + t.duration_s.toFixed(1) + 's, ' +
+            (t.size_bytes / 1e6).toFixed(1) + ' MB, ' + t.encoder + '</p>';
+          gallery.appendChild(div);
+        });
+      });
+  </script>
+</body>
+</html>
+`
+
+// indexHandler serves the static gallery at "/" and falls back to
+// fileServer (a plain directory listing of outDir) for everything else,
+// e.g. the timelapse video files themselves.
+func indexHandler(fileServer http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(indexHTML))
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	}
+}
+
+// registerAPIHandlers wires up the /api/ endpoints and the static gallery
+// at "/" onto mux.
+func registerAPIHandlers(mux *http.ServeMux, outDir string, status *Status, regenerate func(date time.Time)) {
+	mux.HandleFunc("/api/timelapses", timelapsesHandler(outDir))
+	mux.HandleFunc("/api/status", statusHandler(status))
+	mux.HandleFunc("/api/regenerate", regenerateHandler(regenerate))
+	mux.HandleFunc("/", indexHandler(http.FileServer(http.Dir(outDir))))
+}
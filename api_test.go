@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListTimelapses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timelapse-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	videoPath := filepath.Join(dir, "2017-07-23.mp4")
+	if err := ioutil.WriteFile(videoPath, []byte("fake video bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTimelapseMeta(videoPath, timelapseMeta{FrameCount: 100, FPS: 20, Encoder: "ffmpeg"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a timelapse with no matching sidecar metadata
+	if err := ioutil.WriteFile(filepath.Join(dir, "2017-07-24.avi"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// not a timelapse; should be ignored
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<html></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := listTimelapses(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(infos))
+
+	assert.Equal(t, "2017-07-23", infos[0].Date)
+	assert.Equal(t, "/2017-07-23.mp4", infos[0].URL)
+	assert.Equal(t, 100, infos[0].FrameCount)
+	assert.Equal(t, "ffmpeg", infos[0].Encoder)
+	assert.Equal(t, 5.0, infos[0].DurationS)
+
+	assert.Equal(t, "2017-07-24", infos[1].Date)
+	assert.Equal(t, 0, infos[1].FrameCount)
+}
+
+func TestStatusLifecycle(t *testing.T) {
+	status := &Status{}
+
+	status.start(RunStateScanning, 0)
+	status.start(RunStateEncoding, 2)
+	status.setError(errors.New("boom"))
+	status.idle()
+
+	snap := status.snapshot()
+	assert.Equal(t, string(RunStateIdle), snap.State)
+	assert.Equal(t, "boom", snap.LastError)
+
+	// a subsequent run should clear the stale error from the one before it
+	status.start(RunStateScanning, 0)
+	status.start(RunStateEncoding, 1)
+	status.increment()
+	status.idle()
+
+	snap = status.snapshot()
+	assert.Equal(t, 0, snap.Progress)
+	assert.Equal(t, "", snap.LastError, "a fresh run should clear errors left over from a previous failed run")
+}
+
+func TestRegenerateHandler(t *testing.T) {
+	calls := make(chan time.Time, 1)
+	handler := regenerateHandler(func(date time.Time) {
+		calls <- date
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/regenerate?date=2017-07-23", nil)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	select {
+	case got := <-calls:
+		assert.Equal(t, "2017-07-23", FormatDate(got))
+	case <-time.After(time.Second):
+		t.Fatal("regenerate callback was not invoked")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/regenerate?date=not-a-date", nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/regenerate?date=2017-07-23", nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -2,15 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/pkg/errors"
+	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/image/draw"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -48,14 +60,75 @@ func TimesOnSameDay(t1, t2 time.Time) bool {
 	return t1.Year() == t2.Year() && t1.Month() == t2.Month() && t1.Day() == t2.Day()
 }
 
+// TimestampSource records where an ImageFileInfo's Timestamp came from, in
+// decreasing order of confidence. Downstream grouping can use this to prefer
+// higher-confidence values when timestamps disagree.
+type TimestampSource int
+
+const (
+	TimestampSourceExif TimestampSource = iota
+	TimestampSourceFilename
+	TimestampSourceModTime
+)
+
+func (s TimestampSource) String() string {
+	switch s {
+	case TimestampSourceExif:
+		return "exif"
+	case TimestampSourceFilename:
+		return "filename"
+	case TimestampSourceModTime:
+		return "mtime"
+	default:
+		return "unknown"
+	}
+}
+
+// ExtractTimestamp determines the capture time of the image at path. It
+// tries, in order: the EXIF DateTimeOriginal tag, the legacy
+// "<unix>-image.jpg" filename convention, and finally the file's
+// modification time. This lets the server ingest photos from arbitrary
+// cameras/phones without requiring them to be renamed first.
+func ExtractTimestamp(path string) (time.Time, TimestampSource, error) {
+	if f, err := os.Open(path); err == nil {
+		x, decodeErr := exif.Decode(f)
+		f.Close()
+		if decodeErr == nil {
+			if tm, err := x.DateTime(); err == nil {
+				return tm, TimestampSourceExif, nil
+			}
+		}
+	}
+
+	if tm, err := ImageFileToTimestamp(filepath.Base(path)); err == nil {
+		return tm, TimestampSourceFilename, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, TimestampSourceModTime, err
+	}
+	return info.ModTime(), TimestampSourceModTime, nil
+}
+
 type ImageFileInfo struct {
-	Filename   string
-	Timestamp  time.Time
-	Brightness float64
+	Filename        string
+	Timestamp       time.Time
+	TimestampSource TimestampSource
+	Brightness      float64
+
+	// Hash is the content hash of the file, used to detect duplicate
+	// frames and to key the brightness cache.
+	Hash string
+	// Size is the file size in bytes, recorded alongside Hash in the cache.
+	Size int64
+	// FromCache is true if Brightness was populated from the cache
+	// rather than computed fresh.
+	FromCache bool
 }
 
 func (info ImageFileInfo) String() string {
-	return fmt.Sprintf("%s, %s, %0.2f", info.Filename, info.Timestamp.String(), info.Brightness)
+	return fmt.Sprintf("%s, %s (%s), %0.2f", info.Filename, info.Timestamp.String(), info.TimestampSource, info.Brightness)
 }
 
 /* Sort slices of ImageFileInfo objects */
@@ -67,98 +140,401 @@ func (slice ImageFileInfos) Len() int {
 }
 
 func (slice ImageFileInfos) Less(i, j int) bool {
-	return slice[j].Timestamp.After(slice[i].Timestamp)
+	if !slice[i].Timestamp.Equal(slice[j].Timestamp) {
+		return slice[j].Timestamp.After(slice[i].Timestamp)
+	}
+	// Timestamps tie (e.g. two images sharing the same EXIF second, or
+	// mtime granularity): prefer ordering the higher-confidence source
+	// first, since TimestampSource's values are already declared in
+	// decreasing order of confidence.
+	return slice[i].TimestampSource < slice[j].TimestampSource
 }
 
 func (slice ImageFileInfos) Swap(i, j int) {
 	slice[i], slice[j] = slice[j], slice[i]
 }
 
-func CalculateImageBrightness(filepath string) (float64, error) {
-	// run python script to calculate image brightness
-	cmd := exec.Command("./image_brightness.py", filepath)
-	var outbuf, errbuf bytes.Buffer
-	cmd.Stdout, cmd.Stderr = &outbuf, &errbuf
-	err := cmd.Run()
+// HashFile returns the hex-encoded SHA-256 hash of a file's contents along
+// with its size, for use as a content-addressable cache key.
+func HashFile(path string) (hash string, size int64, err error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return 0, errors.Wrap(err, errbuf.String())
+		return "", 0, err
 	}
+	defer f.Close()
 
-	brightnessStr := strings.TrimSpace(outbuf.String())
+	h := sha256.New()
+	size, err = io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
 
-	brightness, err := strconv.ParseFloat(brightnessStr, 64)
-	return brightness, err
+	return hex.EncodeToString(h.Sum(nil)), size, nil
 }
 
-// @Return filtered and sorted images
-func ReadImageFileInfos(imgDir string, excludeDates []time.Time) ImageFileInfos {
-	files, err := ioutil.ReadDir(imgDir)
+// cacheEntry is a single record in the on-disk brightness cache.
+type cacheEntry struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Brightness float64   `json:"brightness"`
+	Size       int64     `json:"size"`
+}
+
+// ImageCache is a persistent, content-addressable cache mapping a file's
+// hash to its previously-computed timestamp and brightness. It lets
+// ReadImageFileInfos skip the (expensive, Python subprocess-backed)
+// brightness computation for files it has already seen, turning each
+// incremental update into roughly O(n*hash) instead of O(n*python).
+type ImageCache struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string]cacheEntry
+}
+
+// NewImageCache loads the cache stored under cacheDir, if any. cacheDir
+// should NOT be (or be inside) the publicly-served output directory: the
+// cache file exposes per-image hash/timestamp/brightness/size data that
+// isn't meant to be served to clients.
+func NewImageCache(cacheDir string) *ImageCache {
+	c := &ImageCache{
+		path:    filepath.Join(cacheDir, "brightness.json"),
+		entries: make(map[string]cacheEntry),
+	}
+
+	data, err := ioutil.ReadFile(c.path)
 	if err != nil {
-		log.Fatal(err)
+		return c
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		log.Printf("Ignoring corrupt image cache %s: %v\n", c.path, err)
 	}
 
-	var mutex = &sync.Mutex{}
-	var imageInfos = make(ImageFileInfos, 0)
+	return c
+}
 
-	var wg sync.WaitGroup
-	wg.Add(len(files))
+// Get returns the cached entry for hash, if present.
+func (c *ImageCache) Get(hash string) (cacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[hash]
+	return entry, ok
+}
+
+// Put records the computed entry for hash.
+func (c *ImageCache) Put(hash string, entry cacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[hash] = entry
+}
+
+// Clear discards all cached entries, e.g. when --rehash is requested.
+func (c *ImageCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries = make(map[string]cacheEntry)
+}
+
+// Save persists the cache to disk.
+func (c *ImageCache) Save() error {
+	c.mutex.Lock()
+	data, err := json.MarshalIndent(c.entries, "", "  ")
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(c.path, data, 0644)
+}
 
-	processImage := func(file os.FileInfo) {
-		defer wg.Done()
+// Decoder decodes image data from r into an image.Image.
+type Decoder func(r io.Reader) (image.Image, error)
+
+// Decoders maps a (lowercased, dot-prefixed) file extension to the Decoder
+// capable of reading it. New capture formats can be supported by adding an
+// entry here instead of shelling out to an external tool.
+var Decoders = map[string]Decoder{
+	".jpg":  jpeg.Decode,
+	".jpeg": jpeg.Decode,
+	".png":  png.Decode,
+	".gif":  gif.Decode,
+	// TODO: HEIC (iPhone default) has no pure-Go decoder yet; add one
+	// here (likely cgo-backed) once the server needs to ingest it.
+}
+
+// brightnessSampleSize is the side length, in pixels, that images are
+// downsampled to before averaging brightness.
+const brightnessSampleSize = 100
+
+// CalculateImageBrightness decodes the image at path using the Decoder
+// registered for its extension, downsamples it, and returns the average
+// luma of the result normalized to [0, 1].
+func CalculateImageBrightness(path string) (float64, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	decode, ok := Decoders[ext]
+	if !ok {
+		return 0, errors.Errorf("no brightness decoder registered for %q", ext)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
 
-		if file.Size() == 0 {
-			return
+	img, err := decode(f)
+	if err != nil {
+		return 0, errors.Wrap(err, "decoding image")
+	}
+
+	return averageBrightness(img), nil
+}
+
+// averageBrightness downsamples img to brightnessSampleSize x
+// brightnessSampleSize and averages its luma channel (0.299R + 0.587G +
+// 0.114B), normalized to [0, 1].
+func averageBrightness(img image.Image) float64 {
+	small := image.NewRGBA(image.Rect(0, 0, brightnessSampleSize, brightnessSampleSize))
+	draw.CatmullRom.Scale(small, small.Bounds(), img, img.Bounds(), draw.Over, nil)
+
+	var total float64
+	for y := 0; y < brightnessSampleSize; y++ {
+		for x := 0; x < brightnessSampleSize; x++ {
+			r, g, b, _ := small.At(x, y).RGBA()
+			// RGBA returns components scaled to 16 bits; normalize to
+			// [0, 1] before weighting them.
+			total += 0.299*float64(r)/0xffff + 0.587*float64(g)/0xffff + 0.114*float64(b)/0xffff
 		}
+	}
 
-		ext := filepath.Ext(file.Name())
-		if ext != ".jpg" {
-			return
+	return total / (brightnessSampleSize * brightnessSampleSize)
+}
+
+// isCandidateImage reports whether file looks like an image Source should
+// emit: non-empty, with a registered Decoder for its extension.
+func isCandidateImage(file os.FileInfo) bool {
+	if file.Size() == 0 {
+		return false
+	}
+	_, ok := Decoders[strings.ToLower(filepath.Ext(file.Name()))]
+	return ok
+}
+
+// CountCandidateImages returns the number of files in imgDir that Source
+// would emit, without running the rest of the ingest pipeline. Callers can
+// use this to size a progress counter before a scan begins.
+func CountCandidateImages(imgDir string) (int, error) {
+	files, err := ioutil.ReadDir(imgDir)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, file := range files {
+		if isCandidateImage(file) {
+			count++
 		}
+	}
+	return count, nil
+}
 
-		tm, err := ImageFileToTimestamp(file.Name())
+// Source walks imgDir and emits the path of each candidate image file.
+// It is the first stage of the Source -> Parse -> ComputeBrightness
+// ingest pipeline.
+func Source(ctx context.Context, imgDir string) <-chan string {
+	out := make(chan string)
+
+	go func() {
+		defer close(out)
+
+		files, err := ioutil.ReadDir(imgDir)
 		if err != nil {
-			log.Fatal(err) // TODO
+			log.Fatal(err)
 		}
 
-		// TODO: make this not be O(n^2)
-		for _, excludedDay := range excludeDates {
-			if TimesOnSameDay(tm, excludedDay) {
-				// filtered out, we're done here
+		for _, file := range files {
+			if !isCandidateImage(file) {
+				continue
+			}
+
+			select {
+			case out <- filepath.Join(imgDir, file.Name()):
+			case <-ctx.Done():
 				return
 			}
 		}
+	}()
 
-		log.Printf("calculating brightness %s\n", file.Name())
+	return out
+}
 
-		fpath := filepath.Join(imgDir, file.Name())
-		b, err := CalculateImageBrightness(fpath)
-		if err != nil {
-			log.Fatal(err)
-		}
+// Parse resolves the timestamp of each incoming image path and drops the
+// ones that fall on an excluded day, emitting an ImageFileInfo (with
+// Brightness not yet computed) for the rest.
+func Parse(ctx context.Context, in <-chan string, excludeDates []time.Time) <-chan ImageFileInfo {
+	out := make(chan ImageFileInfo)
 
-		info := ImageFileInfo{
-			Filename:   file.Name(),
-			Timestamp:  tm,
-			Brightness: b,
+	go func() {
+		defer close(out)
+
+		for fpath := range in {
+			tm, src, err := ExtractTimestamp(fpath)
+			if err != nil {
+				log.Fatal(err) // TODO
+			}
+
+			excluded := false
+			// TODO: make this not be O(n^2)
+			for _, excludedDay := range excludeDates {
+				if TimesOnSameDay(tm, excludedDay) {
+					excluded = true
+					break
+				}
+			}
+			if excluded {
+				continue
+			}
+
+			info := ImageFileInfo{
+				Filename:        filepath.Base(fpath),
+				Timestamp:       tm,
+				TimestampSource: src,
+			}
+
+			select {
+			case out <- info:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
 
-		mutex.Lock()
-		imageInfos = append(imageInfos, info)
-		mutex.Unlock()
-	}
+	return out
+}
 
-	parallel := false
+// Dedup hashes each incoming image's contents, dropping any whose hash has
+// already been seen in this run (an exact-duplicate frame would otherwise
+// produce a stutter in the timelapse). It also consults cache, filling in
+// Brightness and FromCache for hashes that were already computed on a
+// previous run so ComputeBrightness can skip them.
+func Dedup(ctx context.Context, imgDir string, cache *ImageCache, in <-chan ImageFileInfo) <-chan ImageFileInfo {
+	out := make(chan ImageFileInfo)
 
-	if parallel {
-		// Process all image files concurrently, adding the results to imageInfos
-		for _, file := range files {
-			go processImage(file)
+	go func() {
+		defer close(out)
+
+		seen := make(map[string]bool)
+
+		for info := range in {
+			fpath := filepath.Join(imgDir, info.Filename)
+			hash, size, err := HashFile(fpath)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if seen[hash] {
+				log.Println("Skipping duplicate frame: ", info.Filename)
+				continue
+			}
+			seen[hash] = true
+
+			info.Hash = hash
+			info.Size = size
+			if entry, ok := cache.Get(hash); ok {
+				info.Brightness = entry.Brightness
+				info.FromCache = true
+			}
+
+			select {
+			case out <- info:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
+
+	return out
+}
+
+// ComputeBrightness fans incoming ImageFileInfos out across a bounded pool
+// of `workers` goroutines to compute Brightness. Each computation decodes
+// and downsamples an image, so one goroutine per file would oversubscribe
+// the system; this caps concurrency instead. Infos already populated from
+// the cache (FromCache) pass through untouched. An image that fails to
+// decode (truncated/corrupt/unsupported) is logged and dropped rather than
+// aborting the whole run.
+func ComputeBrightness(ctx context.Context, imgDir string, cache *ImageCache, in <-chan ImageFileInfo, workers int) <-chan ImageFileInfo {
+	out := make(chan ImageFileInfo)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for info := range in {
+				if info.FromCache {
+					select {
+					case out <- info:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+
+				log.Printf("calculating brightness %s\n", info.Filename)
+
+				fpath := filepath.Join(imgDir, info.Filename)
+				b, err := CalculateImageBrightness(fpath)
+				if err != nil {
+					// A single truncated or corrupt image (common in a
+					// bulk-imported or live capture directory) shouldn't take
+					// down the whole server; skip it and keep going.
+					log.Printf("Error calculating brightness for %s, skipping: %v\n", info.Filename, err)
+					continue
+				}
+				info.Brightness = b
+
+				cache.Put(info.Hash, cacheEntry{
+					Timestamp:  info.Timestamp,
+					Brightness: b,
+					Size:       info.Size,
+				})
+
+				select {
+				case out <- info:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
 
+	go func() {
 		wg.Wait()
-	} else {
-		for _, file := range files {
-			processImage(file)
+		close(out)
+	}()
+
+	return out
+}
+
+// @Return filtered and sorted images
+//
+// onProgress, if non-nil, is called once for each image that completes the
+// pipeline, so a caller can drive a progress counter through a long scan.
+func ReadImageFileInfos(ctx context.Context, imgDir string, excludeDates []time.Time, workers int, cache *ImageCache, onProgress func()) ImageFileInfos {
+	paths := Source(ctx, imgDir)
+	parsed := Parse(ctx, paths, excludeDates)
+	deduped := Dedup(ctx, imgDir, cache, parsed)
+	computed := ComputeBrightness(ctx, imgDir, cache, deduped, workers)
+
+	imageInfos := make(ImageFileInfos, 0)
+	for info := range computed {
+		imageInfos = append(imageInfos, info)
+		if onProgress != nil {
+			onProgress()
 		}
 	}
 
@@ -200,41 +576,192 @@ func FilterAndGroupByDay(imgInfos ImageFileInfos) []ImageFileInfos {
 	return grouped
 }
 
-func GenerateTimelapseForImages(images ImageFileInfos, tmpDir string, imgDir string, outDir string) (string, error) {
-	firstImg := images[0]
-	dayStr := FormatDate(firstImg.Timestamp)
-	manifestFilepath := filepath.Join(tmpDir, dayStr+".txt")
+// transcodeToJPEG decodes the image at path using its registered Decoder
+// and writes a JPEG copy into tmpDir, returning the copy's path.
+func transcodeToJPEG(path string, tmpDir string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	decode, ok := Decoders[ext]
+	if !ok {
+		return "", errors.Errorf("no decoder registered for %q", ext)
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	img, decodeErr := decode(in)
+	in.Close()
+	if decodeErr != nil {
+		return "", errors.Wrap(decodeErr, "decoding image for transcode")
+	}
 
-	// open manifest file
-	manifest, err := os.Create(manifestFilepath)
+	outPath := filepath.Join(tmpDir, strings.TrimSuffix(filepath.Base(path), ext)+".jpg")
+	out, err := os.Create(outPath)
 	if err != nil {
 		return "", err
 	}
+	defer out.Close()
+
+	if err := jpeg.Encode(out, img, nil); err != nil {
+		return "", errors.Wrap(err, "encoding transcoded jpeg")
+	}
+
+	return outPath, nil
+}
+
+// EncodeOptions configures how an Encoder assembles frames into a video.
+type EncodeOptions struct {
+	FPS int
+	// CRF is the constant rate factor (quality) passed to encoders that
+	// support it. Zero means "use the encoder's default".
+	CRF int
+	// Resolution, if non-empty, is a "WIDTHxHEIGHT" string (e.g.
+	// "1920x1080") that output frames are scaled to.
+	Resolution string
+}
+
+// Encoder turns an ordered list of absolute frame paths into a video file.
+// Implementations wrap a specific external tool (mencoder, ffmpeg, ...).
+type Encoder interface {
+	// Encode writes a video built from manifest to out, using tmpDir to
+	// stage any manifest/intermediate files it needs.
+	Encode(manifest []string, tmpDir string, out string, opts EncodeOptions) error
+	// Extension is the file extension (including the dot) this encoder
+	// produces, e.g. ".avi".
+	Extension() string
+	// Name is a short identifier for this encoder, e.g. "mencoder".
+	Name() string
+}
+
+// MencoderEncoder uses mencoder's mf:// pseudo-demuxer to produce an AVI.
+type MencoderEncoder struct{}
+
+func (MencoderEncoder) Extension() string {
+	return ".avi"
+}
+
+func (MencoderEncoder) Name() string {
+	return "mencoder"
+}
+
+func (MencoderEncoder) Encode(manifest []string, tmpDir string, out string, opts EncodeOptions) error {
+	manifestFilepath := filepath.Join(tmpDir, "mencoder-manifest.txt")
+	f, err := os.Create(manifestFilepath)
+	if err != nil {
+		return err
+	}
+	for _, frame := range manifest {
+		f.WriteString(frame)
+		f.WriteString("\n")
+	}
+	f.Close()
+
+	args := []string{"-nosound", "-ovc", "lavc", "-mf", fmt.Sprintf("type=jpeg:fps=%d", opts.FPS), fmt.Sprintf("mf://@%s", manifestFilepath), "-o", out}
+	if opts.Resolution != "" {
+		args = append(args, "-vf", "scale="+strings.Replace(opts.Resolution, "x", ":", 1))
+	}
+
+	cmd := exec.Command("mencoder", args...)
+	var outbuf, errbuf bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &outbuf, &errbuf
+	if err := cmd.Run(); err != nil {
+		return errors.Wrap(err, outbuf.String())
+	}
+
+	return nil
+}
+
+// FFmpegEncoder uses ffmpeg's concat demuxer to produce an mp4 (libx264)
+// or webm (libvpx-vp9), depending on Format.
+type FFmpegEncoder struct {
+	// Format is the output container/codec: "mp4" or "webm".
+	Format string
+}
+
+func (e FFmpegEncoder) Extension() string {
+	return "." + e.Format
+}
+
+func (FFmpegEncoder) Name() string {
+	return "ffmpeg"
+}
+
+func (e FFmpegEncoder) Encode(manifest []string, tmpDir string, out string, opts EncodeOptions) error {
+	manifestFilepath := filepath.Join(tmpDir, "ffmpeg-manifest.txt")
+	f, err := os.Create(manifestFilepath)
+	if err != nil {
+		return err
+	}
+	for _, frame := range manifest {
+		fmt.Fprintf(f, "file '%s'\n", frame)
+	}
+	f.Close()
+
+	codec := "libx264"
+	if e.Format == "webm" {
+		codec = "libvpx-vp9"
+	}
 
+	args := []string{"-y", "-f", "concat", "-safe", "0", "-r", strconv.Itoa(opts.FPS), "-i", manifestFilepath, "-c:v", codec}
+	if opts.CRF > 0 {
+		args = append(args, "-crf", strconv.Itoa(opts.CRF))
+	}
+	if opts.Resolution != "" {
+		args = append(args, "-vf", "scale="+strings.Replace(opts.Resolution, "x", ":", 1))
+	}
+	args = append(args, out)
+
+	cmd := exec.Command("ffmpeg", args...)
+	var outbuf, errbuf bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &outbuf, &errbuf
+	if err := cmd.Run(); err != nil {
+		return errors.Wrap(err, errbuf.String())
+	}
+
+	return nil
+}
+
+func GenerateTimelapseForImages(images ImageFileInfos, tmpDir string, imgDir string, outDir string, encoder Encoder, opts EncodeOptions) (string, error) {
+	firstImg := images[0]
+	dayStr := FormatDate(firstImg.Timestamp)
+
+	manifest := make([]string, 0, len(images))
 	for _, img := range images {
 		imgFilepath, err := filepath.Abs(filepath.Join(imgDir, img.Filename))
 		if err != nil {
 			return "", err
 		}
-		manifest.WriteString(imgFilepath)
-		manifest.WriteString("\n")
+
+		// mencoder's mf:// manifest only understands JPEG frames, so
+		// non-JPEG inputs (PNG, HEIC, ...) need a transcoded working copy.
+		if strings.ToLower(filepath.Ext(imgFilepath)) != ".jpg" {
+			imgFilepath, err = transcodeToJPEG(imgFilepath, tmpDir)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		manifest = append(manifest, imgFilepath)
 	}
-	manifest.Close()
 
-	// use mencoder create timelapse video in output directory
-	outPath := filepath.Join(outDir, dayStr+".avi")
-	fps := 20
-	cmd := exec.Command("mencoder", "-nosound", "-ovc", "lavc", "-mf", fmt.Sprintf("type=jpeg:fps=%d", fps), fmt.Sprintf("mf://@%s", manifestFilepath), "-o", outPath)
-	var outbuf, errbuf bytes.Buffer
-	cmd.Stdout, cmd.Stderr = &outbuf, &errbuf
-	if err := cmd.Run(); err != nil {
-		return "", errors.Wrap(err, outbuf.String())
+	outPath := filepath.Join(outDir, dayStr+encoder.Extension())
+	if err := encoder.Encode(manifest, tmpDir, outPath, opts); err != nil {
+		return "", err
+	}
+
+	meta := timelapseMeta{FrameCount: len(manifest), FPS: opts.FPS, Encoder: encoder.Name()}
+	if err := writeTimelapseMeta(outPath, meta); err != nil {
+		log.Printf("Error writing timelapse metadata for %s: %v\n", outPath, err)
 	}
 
 	return outPath, nil
 }
 
-func GenerateDailyTimelapses(grouping []ImageFileInfos, imgDir string, outDir string) {
+// GenerateDailyTimelapses builds a timelapse for each day group in
+// parallel. status, if non-nil, is updated with per-day progress as the
+// RunStateEncoding phase runs; the caller is responsible for calling
+// status.start beforehand.
+func GenerateDailyTimelapses(grouping []ImageFileInfos, imgDir string, outDir string, encoder Encoder, opts EncodeOptions, status *Status) {
 	tmpDir, err := ioutil.TempDir("/tmp", "timelapse")
 	if err != nil {
 		log.Fatal(err)
@@ -246,12 +773,18 @@ func GenerateDailyTimelapses(grouping []ImageFileInfos, imgDir string, outDir st
 	for _, infos := range grouping {
 		go func(infos ImageFileInfos) {
 			defer wg.Done()
-			outPath, err := GenerateTimelapseForImages(infos, tmpDir, imgDir, outDir)
+			outPath, err := GenerateTimelapseForImages(infos, tmpDir, imgDir, outDir, encoder, opts)
 			if err != nil {
 				log.Println("Error generating timelapse ", err)
+				if status != nil {
+					status.setError(err)
+				}
 				return
 			}
 
+			if status != nil {
+				status.increment()
+			}
 			log.Printf("Created timelapse at '%s'\n", outPath)
 		}(infos)
 	}
@@ -264,6 +797,14 @@ func ParseDate(dateStr string) (time.Time, error) {
 	return time.Parse(layout, dateStr)
 }
 
+// timelapseExtensions are the file extensions DetectExistingTimelapses
+// recognizes as previously-generated timelapses, across all Encoders.
+var timelapseExtensions = map[string]bool{
+	".avi":  true,
+	".mp4":  true,
+	".webm": true,
+}
+
 // Get timestamps of timelapses that already exist in the output directory
 func DetectExistingTimelapses(outDir string) []time.Time {
 	files, err := ioutil.ReadDir(outDir)
@@ -273,11 +814,10 @@ func DetectExistingTimelapses(outDir string) []time.Time {
 
 	var videoTimestamps []time.Time
 
-	// Process all image files concurrently, adding the results to imageInfos
 	for _, file := range files {
 		ext := filepath.Ext(file.Name())
-		if ext != ".avi" {
-			return nil
+		if !timelapseExtensions[ext] {
+			continue
 		}
 
 		tms := strings.Replace(file.Name(), ext, "", -1)
@@ -297,6 +837,14 @@ func main() {
 	outDir := flag.String("out-dir", "", "Directory to store completed timelapses and html. This directory will be served publicly, so don't put anything secret in here.")
 	httpPort := flag.String("port", "8888", "Port to serve on")
 	updateInterval := flag.Int("update-interval", 60*60, "How often, in seconds, to regenerate all timelapses.")
+	workers := flag.Int("workers", runtime.NumCPU(), "Number of images to process concurrently when computing brightness")
+	rehash := flag.Bool("rehash", false, "Ignore the on-disk brightness cache and recompute brightness for every image")
+	encoderName := flag.String("encoder", "mencoder", "Video encoder backend to use: \"mencoder\" or \"ffmpeg\"")
+	format := flag.String("format", "mp4", "Output format for the ffmpeg encoder: \"mp4\" or \"webm\" (the mencoder encoder always produces .avi)")
+	fps := flag.Int("fps", 20, "Frames per second in generated timelapses")
+	crf := flag.Int("crf", 23, "Constant rate factor (quality) for the ffmpeg encoder; lower is higher quality, 0 uses the encoder default")
+	resolution := flag.String("resolution", "", "Optional output resolution, e.g. \"1920x1080\"; empty leaves frames at their native size")
+	cacheDir := flag.String("cache-dir", "", "Directory to store the brightness cache in (default: a .cache directory next to --image-dir). Must not be --out-dir or a subdirectory of it, since that directory is served publicly.")
 	flag.Parse()
 
 	if *outDir == "" {
@@ -305,25 +853,127 @@ func main() {
 		os.Exit(1)
 	}
 
-	updateAll := func() {
-		log.Printf("Detecting existing timelapses...\n")
-		existing := DetectExistingTimelapses(*outDir)
-		var excludeDates []time.Time
-		if len(existing) > 0 {
-			excludeDates = existing[:len(existing)-1]
-		} else {
-			excludeDates = existing
+	if *workers < 1 {
+		fmt.Fprintf(os.Stderr, "--workers must be >= 1, got %d\n", *workers)
+		os.Exit(1)
+	}
+
+	if *cacheDir == "" {
+		*cacheDir = filepath.Join(*imgDir, ".cache")
+	}
+
+	var encoder Encoder
+	switch *encoderName {
+	case "mencoder":
+		encoder = MencoderEncoder{}
+	case "ffmpeg":
+		encoder = FFmpegEncoder{Format: *format}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown encoder %q: must be \"mencoder\" or \"ffmpeg\"\n", *encoderName)
+		os.Exit(1)
+	}
+	encodeOpts := EncodeOptions{FPS: *fps, CRF: *crf, Resolution: *resolution}
+
+	cache := NewImageCache(*cacheDir)
+	if *rehash {
+		cache.Clear()
+	}
+
+	status := &Status{}
+
+	var (
+		runMutex    sync.Mutex
+		cancelMutex sync.Mutex
+		cancelPrev  context.CancelFunc
+	)
+
+	// runExclusive cancels whatever run is currently in flight (if it's
+	// still in a cancellable stage) and then waits its turn to run fn under
+	// runMutex. Both updateAll and regenerate go through this so that two
+	// runs can never encode into the same outDir/<date>.<ext> path at once.
+	runExclusive := func(fn func(ctx context.Context)) {
+		cancelMutex.Lock()
+		if cancelPrev != nil {
+			cancelPrev()
 		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelPrev = cancel
+		cancelMutex.Unlock()
+		defer cancel()
 
-		log.Printf("=> Done detecting timelapses. Found %d\n", len(existing))
+		runMutex.Lock()
+		defer runMutex.Unlock()
 
-		log.Printf("Reading image directory...\n")
-		imageInfos := ReadImageFileInfos(*imgDir, excludeDates)
-		log.Printf("=> Found %d images\n", len(imageInfos))
-		grouped := FilterAndGroupByDay(imageInfos)
+		fn(ctx)
+	}
 
-		log.Printf("Generating %d timelapses...\n", len(grouped))
-		GenerateDailyTimelapses(grouped, *imgDir, *outDir)
+	updateAll := func() {
+		runExclusive(func(ctx context.Context) {
+			log.Printf("Detecting existing timelapses...\n")
+			existing := DetectExistingTimelapses(*outDir)
+			var excludeDates []time.Time
+			if len(existing) > 0 {
+				excludeDates = existing[:len(existing)-1]
+			} else {
+				excludeDates = existing
+			}
+
+			log.Printf("=> Done detecting timelapses. Found %d\n", len(existing))
+
+			log.Printf("Reading image directory...\n")
+			total, err := CountCandidateImages(*imgDir)
+			if err != nil {
+				log.Printf("Error counting images in %s: %v\n", *imgDir, err)
+			}
+			status.start(RunStateScanning, total)
+			imageInfos := ReadImageFileInfos(ctx, *imgDir, excludeDates, *workers, cache, status.increment)
+			log.Printf("=> Found %d images\n", len(imageInfos))
+			if err := cache.Save(); err != nil {
+				log.Printf("Error saving image cache: %v\n", err)
+			}
+			grouped := FilterAndGroupByDay(imageInfos)
+
+			log.Printf("Generating %d timelapses...\n", len(grouped))
+			status.start(RunStateEncoding, len(grouped))
+			GenerateDailyTimelapses(grouped, *imgDir, *outDir, encoder, encodeOpts, status)
+			status.idle()
+		})
+	}
+
+	// regenerate rebuilds the timelapse for a single day on demand, e.g.
+	// from a POST /api/regenerate request. It runs under the same
+	// runExclusive lock as updateAll so it can't race a periodic tick (or
+	// another regenerate call) that's encoding at the same time.
+	regenerate := func(date time.Time) {
+		runExclusive(func(ctx context.Context) {
+			log.Printf("Regenerating timelapse for %s...\n", FormatDate(date))
+			total, err := CountCandidateImages(*imgDir)
+			if err != nil {
+				log.Printf("Error counting images in %s: %v\n", *imgDir, err)
+			}
+			status.start(RunStateScanning, total)
+			imageInfos := ReadImageFileInfos(ctx, *imgDir, nil, *workers, cache, status.increment)
+			if err := cache.Save(); err != nil {
+				log.Printf("Error saving image cache: %v\n", err)
+			}
+
+			var dayImages ImageFileInfos
+			for _, info := range imageInfos {
+				if TimesOnSameDay(info.Timestamp, date) {
+					dayImages = append(dayImages, info)
+				}
+			}
+			if len(dayImages) == 0 {
+				status.setError(errors.Errorf("no images found for %s", FormatDate(date)))
+				status.idle()
+				return
+			}
+
+			grouped := FilterAndGroupByDay(dayImages)
+			status.start(RunStateEncoding, len(grouped))
+			GenerateDailyTimelapses(grouped, *imgDir, *outDir, encoder, encodeOpts, status)
+			status.idle()
+		})
 	}
 
 	go updateAll()
@@ -337,8 +987,9 @@ func main() {
 		}
 	}()
 
-	// periodically regenerate timelapse videos
-	go log.Printf("Serving '%s' on port '%s'\n", *outDir, *httpPort)
-	http.Handle("/", http.FileServer(http.Dir(*outDir)))
-	log.Fatal(http.ListenAndServe(":"+*httpPort, nil))
+	mux := http.NewServeMux()
+	registerAPIHandlers(mux, *outDir, status, regenerate)
+
+	log.Printf("Serving '%s' on port '%s'\n", *outDir, *httpPort)
+	log.Fatal(http.ListenAndServe(":"+*httpPort, mux))
 }
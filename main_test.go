@@ -1,22 +1,241 @@
 package main
 
 import (
+	"context"
+	"encoding/binary"
 	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
 	"sort"
 	"testing"
 	"time"
 )
 
+// writeMinimalTIFFWithDateTime writes a minimal little-endian TIFF file
+// containing a single IFD0 DateTime (0x0132) tag. goexif's exif.Decode
+// accepts raw TIFF data directly (it only unwraps the JPEG APP1/Exif
+// wrapper when the input isn't already TIFF), so this is enough to
+// exercise the EXIF path of ExtractTimestamp without a real camera image.
+func writeMinimalTIFFWithDateTime(t *testing.T, path string, dateTime string) {
+	value := append([]byte(dateTime), 0) // NUL-terminated, per the TIFF ASCII type
+
+	const ifd0Offset = 8
+	const entryCount = 1
+	const entrySize = 12
+	valueOffset := uint32(ifd0Offset + 2 + entryCount*entrySize + 4)
+
+	buf := make([]byte, valueOffset)
+	copy(buf[0:4], []byte("II*\x00"))
+	binary.LittleEndian.PutUint32(buf[4:8], ifd0Offset)
+	binary.LittleEndian.PutUint16(buf[8:10], entryCount)
+	binary.LittleEndian.PutUint16(buf[10:12], 0x0132) // DateTime tag
+	binary.LittleEndian.PutUint16(buf[12:14], 2)       // type 2 == ASCII
+	binary.LittleEndian.PutUint32(buf[14:18], uint32(len(value)))
+	binary.LittleEndian.PutUint32(buf[18:22], valueOffset)
+	binary.LittleEndian.PutUint32(buf[22:26], 0) // no next IFD
+
+	buf = append(buf, value...)
+
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestExtractTimestampFromExif covers the highest-confidence path: a file
+// with a readable EXIF DateTime tag.
+func TestExtractTimestampFromExif(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract-timestamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "photo.jpg")
+	writeMinimalTIFFWithDateTime(t, path, "2017:07:23 10:00:00")
+
+	expected, err := time.ParseInLocation("2006:01:02 15:04:05", "2017:07:23 10:00:00", time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tm, src, err := ExtractTimestamp(path)
+	assert.Nil(t, err)
+	assert.Equal(t, TimestampSourceExif, src)
+	assert.True(t, expected.Equal(tm), "expected %v, got %v", expected, tm)
+}
+
+// TestExtractTimestampFromFilename covers the fallback used when a file has
+// no (or unreadable) EXIF data but matches the "<unix>-image.jpg" naming
+// convention.
+func TestExtractTimestampFromFilename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract-timestamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "1500872173-image.jpg")
+	writeSolidImage(t, path, color.RGBA{255, 255, 255, 255})
+
+	tm, src, err := ExtractTimestamp(path)
+	assert.Nil(t, err)
+	assert.Equal(t, TimestampSourceFilename, src)
+	assert.True(t, time.Unix(1500872173, 0).Equal(tm))
+}
+
+// TestExtractTimestampFromModTime covers the last-resort fallback: a file
+// with no EXIF data and a name that doesn't match the filename convention.
+func TestExtractTimestampFromModTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract-timestamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "photo.jpg")
+	writeSolidImage(t, path, color.RGBA{255, 255, 255, 255})
+
+	mtime := time.Date(2018, time.March, 4, 5, 6, 7, 0, time.Local)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	tm, src, err := ExtractTimestamp(path)
+	assert.Nil(t, err)
+	assert.Equal(t, TimestampSourceModTime, src)
+	assert.True(t, mtime.Equal(tm), "expected %v, got %v", mtime, tm)
+}
+
+// writeSolidImage writes a single-color test image to path, encoding it
+// according to path's extension (.png or .jpg).
+func writeSolidImage(t *testing.T, path string, col color.Color) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(img, img.Bounds(), &image.Uniform{col}, image.Point{}, draw.Src)
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	switch filepath.Ext(path) {
+	case ".png":
+		err = png.Encode(f, img)
+	case ".jpg", ".jpeg":
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: 100})
+	default:
+		t.Fatalf("unsupported test image extension %q", filepath.Ext(path))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCalculateImageBrightness pins CalculateImageBrightness's luma
+// weighting and downsampling to exact, analytically-known values using
+// solid-color fixtures, rather than a single opaque expected value, so a
+// regression in either step fails loudly.
 func TestCalculateImageBrightness(t *testing.T) {
-	brightness, err := CalculateImageBrightness("example/1500872173-image.jpg")
+	dir, err := ioutil.TempDir("", "brightness-fixtures")
 	if err != nil {
-		t.Fatal("Error calculating image brightness ", err)
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		filename string
+		color    color.RGBA
+		expected float64
+		delta    float64
+	}{
+		{"white.png", color.RGBA{255, 255, 255, 255}, 1.0, 0.001},
+		{"black.png", color.RGBA{0, 0, 0, 255}, 0.0, 0.001},
+		{"gray.png", color.RGBA{128, 128, 128, 255}, 128.0 / 255.0, 0.01},
+		// JPEG is lossy, so allow a larger tolerance than the PNG cases.
+		{"white.jpg", color.RGBA{255, 255, 255, 255}, 1.0, 0.02},
 	}
-	assert.Equalf(t, 0.36, brightness, "Check brightness value")
+
+	for _, c := range cases {
+		path := filepath.Join(dir, c.filename)
+		writeSolidImage(t, path, c.color)
+
+		brightness, err := CalculateImageBrightness(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.InDelta(t, c.expected, brightness, c.delta, "brightness of a solid %s image should match its known luma", c.filename)
+	}
+}
+
+// TestComputeBrightnessSkipsDecodeErrors verifies that a single corrupt
+// image doesn't abort the whole brightness pass; it should be logged and
+// dropped, and the remaining images should still make it through.
+func TestComputeBrightnessSkipsDecodeErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "brightness-corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeSolidImage(t, filepath.Join(dir, "good.png"), color.RGBA{255, 255, 255, 255})
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.png"), []byte("not a png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	in := make(chan ImageFileInfo, 2)
+	in <- ImageFileInfo{Filename: "bad.png", Hash: "bad"}
+	in <- ImageFileInfo{Filename: "good.png", Hash: "good"}
+	close(in)
+
+	out := ComputeBrightness(context.Background(), dir, newTestCache(t), in, 1)
+
+	var results []ImageFileInfo
+	for info := range out {
+		results = append(results, info)
+	}
+
+	assert.Equal(t, 1, len(results), "the corrupt image should be skipped rather than aborting the pipeline")
+	assert.Equal(t, "good.png", results[0].Filename)
+}
+
+// TestReadImageFileInfosReportsProgress verifies that CountCandidateImages
+// and ReadImageFileInfos's onProgress callback agree on how many images a
+// scan will process, so a caller can drive a real progress counter (rather
+// than a permanently-0/0 one) through a scan.
+func TestReadImageFileInfosReportsProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "read-image-file-infos-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	colors := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}}
+	for i, name := range []string{"a.png", "b.png", "c.png"} {
+		writeSolidImage(t, filepath.Join(dir, name), colors[i])
+	}
+
+	total, err := CountCandidateImages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, total)
+
+	seen := 0
+	ReadImageFileInfos(context.Background(), dir, nil, runtime.NumCPU(), newTestCache(t), func() { seen++ })
+	assert.Equal(t, total, seen, "onProgress should fire once per image the scan processes")
+}
+
+func newTestCache(t *testing.T) *ImageCache {
+	dir, err := ioutil.TempDir("", "timelapse-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewImageCache(dir)
 }
 
 func TestProcessFiles(t *testing.T) {
-	result := ReadImageFileInfos("./example", make([]time.Time, 0))
+	result := ReadImageFileInfos(context.Background(), "./example", make([]time.Time, 0), runtime.NumCPU(), newTestCache(t), nil)
 	assert.Equal(t, 31, len(result))
 
 	if !sort.IsSorted(result) {
@@ -25,12 +244,28 @@ func TestProcessFiles(t *testing.T) {
 }
 
 func TestFilterAndGroupByDay(t *testing.T) {
-	imgInfos := ReadImageFileInfos("./example", make([]time.Time, 0))
+	imgInfos := ReadImageFileInfos(context.Background(), "./example", make([]time.Time, 0), runtime.NumCPU(), newTestCache(t), nil)
 	grouped := FilterAndGroupByDay(imgInfos)
 
 	assert.Equal(t, 2, len(grouped), "The photos were taken across two days")
 }
 
+// TestImageFileInfosSortPrefersHigherConfidenceOnTie verifies that when two
+// ImageFileInfos share the same Timestamp, sorting breaks the tie in favor
+// of the higher-confidence TimestampSource, per ImageFileInfo's doc comment.
+func TestImageFileInfosSortPrefersHigherConfidenceOnTie(t *testing.T) {
+	tm := time.Unix(1500872173, 0)
+	infos := ImageFileInfos{
+		{Filename: "b.jpg", Timestamp: tm, TimestampSource: TimestampSourceModTime},
+		{Filename: "a.jpg", Timestamp: tm, TimestampSource: TimestampSourceExif},
+		{Filename: "c.jpg", Timestamp: tm, TimestampSource: TimestampSourceFilename},
+	}
+
+	sort.Sort(infos)
+
+	assert.Equal(t, []string{"a.jpg", "c.jpg", "b.jpg"}, []string{infos[0].Filename, infos[1].Filename, infos[2].Filename})
+}
+
 func TestParseDate(t *testing.T) {
 	str := "2017-07-23"
 	tm, err := ParseDate(str)
@@ -39,3 +274,29 @@ func TestParseDate(t *testing.T) {
 	assert.Equal(t, 7, int(tm.Month()))
 	assert.Equal(t, 23, tm.Day())
 }
+
+func TestEncoderExtensionAndName(t *testing.T) {
+	assert.Equal(t, ".avi", MencoderEncoder{}.Extension())
+	assert.Equal(t, "mencoder", MencoderEncoder{}.Name())
+
+	assert.Equal(t, ".mp4", FFmpegEncoder{Format: "mp4"}.Extension())
+	assert.Equal(t, ".webm", FFmpegEncoder{Format: "webm"}.Extension())
+	assert.Equal(t, "ffmpeg", FFmpegEncoder{Format: "mp4"}.Name())
+}
+
+func TestDetectExistingTimelapses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timelapse-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{"2017-07-23.avi", "2017-07-24.mp4", "2017-07-25.webm", "not-a-date.avi", "README.txt"}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	existing := DetectExistingTimelapses(dir)
+	assert.Equal(t, 3, len(existing), "should recognize .avi/.mp4/.webm and skip past unparsable or unrecognized files instead of stopping at the first one")
+}